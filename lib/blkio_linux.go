@@ -0,0 +1,296 @@
+//go:build linux
+// +build linux
+
+package mpiostat
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// BlkioPlugin collects per-cgroup block IO metrics, which /proc/diskstats
+// can't give since it only sees the whole host. It keeps the same
+// mp.PluginWithPrefix contract as IostatPlugin.
+type BlkioPlugin struct {
+	Prefix     string
+	CgroupRoot string
+}
+
+func (b BlkioPlugin) MetricKeyPrefix() string {
+	if b.Prefix == "" {
+		b.Prefix = "disk"
+	}
+	return b.Prefix
+}
+
+// GraphDefinition only has room for a single "#" wildcard segment per
+// graph, but a metric is really keyed by (cgroup, device) pair. cgname and
+// device are flattened into one dash-joined label (see cgroupName and the
+// label construction in parseIOStatV2/parseBlkioThrottleFile/
+// parseBlkioTimeFile) rather than exposed as "cgroup.<cgname>.<device>.*",
+// so a cgroup with several backing devices shows up as several sibling
+// "cgroup.#" series instead of a nested device dimension.
+func (b BlkioPlugin) GraphDefinition() map[string]mp.Graphs {
+	labelPrefix := strings.Title(b.MetricKeyPrefix())
+	return map[string]mp.Graphs{
+		"cgroup.#": {
+			Label: (labelPrefix + " Cgroup IO"),
+			Unit:  mp.UnitFloat,
+			Metrics: []mp.Metrics{
+				{Name: "rbytes", Label: "read bytes", Diff: true},
+				{Name: "wbytes", Label: "write bytes", Diff: true},
+				{Name: "rios", Label: "read ios", Diff: true},
+				{Name: "wios", Label: "write ios", Diff: true},
+				{Name: "dbytes", Label: "discard bytes", Diff: true},
+				{Name: "dios", Label: "discard ios", Diff: true},
+				{Name: "iowaittime", Label: "io wait time", Diff: true},
+				{Name: "ioservicetime", Label: "io service time", Diff: true},
+			},
+		},
+	}
+}
+
+func (b BlkioPlugin) cgroupRoot() string {
+	if b.CgroupRoot == "" {
+		return "/sys/fs/cgroup"
+	}
+	return b.CgroupRoot
+}
+
+// FetchMetrics detects cgroup v1 vs v2 by the presence of
+// cgroup.controllers at the cgroup root, which only exists on the unified
+// (v2) hierarchy.
+func (b BlkioPlugin) FetchMetrics() (map[string]float64, error) {
+	root := b.cgroupRoot()
+
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		return fetchBlkioMetricsV2(root)
+	}
+
+	return fetchBlkioMetricsV1(filepath.Join(root, "blkio"))
+}
+
+// cgroupName turns a cgroup directory into a metric-key-safe label, e.g.
+// "<root>/kubepods/burstable/pod123/abcd" => "kubepods-burstable-pod123-abcd".
+func cgroupName(root, dir string) string {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." {
+		return "root"
+	}
+	return strings.ReplaceAll(rel, string(filepath.Separator), "-")
+}
+
+// resolveBlockDevice maps a "MAJ:MIN" device number, as found in cgroup
+// blkio/io.stat files, to the device name /proc/diskstats uses for it.
+func resolveBlockDevice(majMin string) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/sys/dev/block/%s/uevent", majMin))
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "DEVNAME=") {
+			return strings.TrimPrefix(line, "DEVNAME="), nil
+		}
+	}
+
+	return "", fmt.Errorf("DEVNAME not found in uevent for %s", majMin)
+}
+
+func fetchBlkioMetricsV2(root string) (map[string]float64, error) {
+	metrics := make(map[string]float64)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != "io.stat" {
+			return nil
+		}
+
+		return parseIOStatV2(path, cgroupName(root, filepath.Dir(path)), metrics)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot walk cgroup tree %s: %s", root, err)
+	}
+
+	return metrics, nil
+}
+
+/*
+$ cat io.stat
+8:0 rbytes=1206272 wbytes=0 rios=39 wios=0 dbytes=0 dios=0
+*/
+func parseIOStatV2(path, cgname string, metrics map[string]float64) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Cannot read from file %s: %s", path, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		device, err := resolveBlockDevice(fields[0])
+		if err != nil {
+			continue
+		}
+		label := deviceNamePattern.ReplaceAllString(cgname+"-"+device, "")
+
+		for _, kv := range fields[1:] {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			switch parts[0] {
+			case "rbytes", "wbytes", "rios", "wios", "dbytes", "dios":
+				value, err := strconv.ParseFloat(parts[1], 64)
+				if err != nil {
+					return fmt.Errorf("Failed to parse value: %s", err)
+				}
+				metrics["cgroup."+label+"."+parts[0]] = value
+			}
+		}
+	}
+
+	return nil
+}
+
+func fetchBlkioMetricsV1(blkioRoot string) (map[string]float64, error) {
+	metrics := make(map[string]float64)
+
+	err := filepath.Walk(blkioRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != "blkio.throttle.io_service_bytes" {
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+		cgname := cgroupName(blkioRoot, dir)
+
+		if err := parseBlkioThrottleFile(path, cgname, "bytes", metrics); err != nil {
+			return err
+		}
+		if err := parseBlkioThrottleFile(filepath.Join(dir, "blkio.throttle.io_serviced"), cgname, "ios", metrics); err != nil {
+			return err
+		}
+		if err := parseBlkioTimeFile(filepath.Join(dir, "blkio.io_wait_time"), cgname, "iowaittime", metrics); err != nil {
+			return err
+		}
+		if err := parseBlkioTimeFile(filepath.Join(dir, "blkio.io_service_time"), cgname, "ioservicetime", metrics); err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot walk cgroup tree %s: %s", blkioRoot, err)
+	}
+
+	return metrics, nil
+}
+
+/*
+$ cat blkio.throttle.io_service_bytes
+8:0 Read 1206272
+8:0 Write 0
+8:0 Sync 0
+8:0 Async 1206272
+8:0 Total 1206272
+Total 1206272
+*/
+func parseBlkioThrottleFile(path, cgname, unit string, metrics map[string]float64) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot read from file %s: %s", path, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+
+		op := strings.ToLower(fields[1])
+		if op != "read" && op != "write" {
+			continue
+		}
+
+		device, err := resolveBlockDevice(fields[0])
+		if err != nil {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return fmt.Errorf("Failed to parse value: %s", err)
+		}
+
+		label := deviceNamePattern.ReplaceAllString(cgname+"-"+device, "")
+		metrics["cgroup."+label+"."+op[:1]+unit] = value // e.g. "rbytes", "wios"
+	}
+
+	return nil
+}
+
+func parseBlkioTimeFile(path, cgname, metricName string, metrics map[string]float64) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot read from file %s: %s", path, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[1] != "Total" {
+			continue
+		}
+
+		device, err := resolveBlockDevice(fields[0])
+		if err != nil {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return fmt.Errorf("Failed to parse value: %s", err)
+		}
+
+		label := deviceNamePattern.ReplaceAllString(cgname+"-"+device, "")
+		metrics["cgroup."+label+"."+metricName] = value
+	}
+
+	return nil
+}
+
+func DoBlkio() {
+	optPrefix := flag.String("metric-key-prefix", "disk", "Metric key prefix")
+	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optCgroupRoot := flag.String("cgroup-root", "/sys/fs/cgroup", "Path to the cgroup filesystem root")
+	flag.Parse()
+
+	b := BlkioPlugin{
+		Prefix:     *optPrefix,
+		CgroupRoot: *optCgroupRoot,
+	}
+	plugin := mp.NewMackerelPlugin(b)
+	plugin.Tempfile = *optTempfile
+	plugin.Run()
+}
@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package mpiostat
+
+import "testing"
+
+func TestCgroupName(t *testing.T) {
+	cases := []struct {
+		root string
+		dir  string
+		want string
+	}{
+		{"/sys/fs/cgroup/blkio", "/sys/fs/cgroup/blkio", "root"},
+		{"/sys/fs/cgroup/blkio", "/sys/fs/cgroup/blkio/docker/abcd1234", "docker-abcd1234"},
+	}
+
+	for _, c := range cases {
+		if got := cgroupName(c.root, c.dir); got != c.want {
+			t.Errorf("cgroupName(%q, %q) = %q, want %q", c.root, c.dir, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package mpiostat
+
+import "log"
+
+// BlkioPlugin is only implemented for linux, where cgroups live.
+type BlkioPlugin struct {
+	Prefix     string
+	CgroupRoot string
+}
+
+func DoBlkio() {
+	log.Fatal("mackerel-plugin-iostat: cgroup/blkio metrics are only supported on Linux")
+}
@@ -0,0 +1,105 @@
+package mpiostat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// derivedState is persisted between runs under its own tempfile, keyed by
+// metric key prefix, so addDerivedMetrics can compute a delta against the
+// previous sample. This is separate from go-mackerel-plugin's own
+// tempfile, which only diffs a single counter and can't derive a ratio
+// such as await or %util.
+type derivedState struct {
+	Timestamp int64                  `json:"timestamp"`
+	Devices   map[string]rawCounters `json:"devices"`
+}
+
+func derivedStateFilePath(prefix string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("mackerel-plugin-iostat-derived-%s", prefix))
+}
+
+func loadDerivedState(prefix string) (*derivedState, error) {
+	data, err := ioutil.ReadFile(derivedStateFilePath(prefix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read from file %s: %s", derivedStateFilePath(prefix), err)
+	}
+
+	state := &derivedState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("Cannot parse derived state: %s", err)
+	}
+
+	return state, nil
+}
+
+func saveDerivedState(prefix string, state *derivedState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Cannot encode derived state: %s", err)
+	}
+
+	if err := ioutil.WriteFile(derivedStateFilePath(prefix), data, 0644); err != nil {
+		return fmt.Errorf("Cannot write to file %s: %s", derivedStateFilePath(prefix), err)
+	}
+
+	return nil
+}
+
+// addDerivedMetrics computes the iostat -x-style await, r_await, w_await,
+// svctm, %util and avgqu-sz metrics for each device in current, using the
+// sample persisted under prefix on the previous run, and folds the result
+// into metrics. Devices with no previous sample (e.g. the first run, or a
+// device that just appeared) are left out rather than divided by zero.
+func addDerivedMetrics(metrics map[string]float64, prefix string, current map[string]rawCounters) error {
+	now := time.Now()
+
+	prev, err := loadDerivedState(prefix)
+	if err != nil {
+		return err
+	}
+
+	if prev != nil {
+		elapsedMs := float64(now.UnixNano()/int64(time.Millisecond) - prev.Timestamp)
+		for device, curr := range current {
+			last, ok := prev.Devices[device]
+			if !ok || elapsedMs <= 0 {
+				continue
+			}
+
+			dReads := curr.Reads - last.Reads
+			dWrites := curr.Writes - last.Writes
+			dTimeRead := curr.TimeRead - last.TimeRead
+			dTimeWrite := curr.TimeWrite - last.TimeWrite
+			dTimeIO := curr.TimeIO - last.TimeIO
+			dTimeIOWeighted := curr.TimeIOWeighted - last.TimeIOWeighted
+			dIOs := dReads + dWrites
+
+			metrics["latency."+device+".await"] = safeDiv(dTimeRead+dTimeWrite, dIOs)
+			metrics["latency."+device+".r_await"] = safeDiv(dTimeRead, dReads)
+			metrics["latency."+device+".w_await"] = safeDiv(dTimeWrite, dWrites)
+			metrics["latency."+device+".svctm"] = safeDiv(dTimeIO, dIOs)
+			metrics["util."+device+".util"] = safeDiv(dTimeIO, elapsedMs) * 100
+			metrics["queue."+device+".avgqu-sz"] = safeDiv(dTimeIOWeighted, elapsedMs)
+		}
+	}
+
+	return saveDerivedState(prefix, &derivedState{
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+		Devices:   current,
+	})
+}
+
+func safeDiv(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
@@ -0,0 +1,61 @@
+package mpiostat
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAddDerivedMetrics(t *testing.T) {
+	prefix := "test-derived-metrics"
+	defer os.Remove(derivedStateFilePath(prefix))
+
+	first := map[string]rawCounters{
+		"vda": {Reads: 100, Writes: 50, TimeRead: 200, TimeWrite: 100, TimeIO: 250, TimeIOWeighted: 500},
+	}
+	metrics := make(map[string]float64)
+	if err := addDerivedMetrics(metrics, prefix, first); err != nil {
+		t.Fatalf("addDerivedMetrics returned error: %s", err)
+	}
+	if len(metrics) != 0 {
+		t.Errorf("addDerivedMetrics should emit nothing on the first sample, got %v", metrics)
+	}
+
+	state, err := loadDerivedState(prefix)
+	if err != nil {
+		t.Fatalf("loadDerivedState returned error: %s", err)
+	}
+	state.Timestamp -= 1000 // pretend the previous sample was taken 1 second ago
+	if err := saveDerivedState(prefix, state); err != nil {
+		t.Fatalf("saveDerivedState returned error: %s", err)
+	}
+
+	second := map[string]rawCounters{
+		"vda": {Reads: 110, Writes: 60, TimeRead: 220, TimeWrite: 130, TimeIO: 280, TimeIOWeighted: 600},
+	}
+	metrics = make(map[string]float64)
+	if err := addDerivedMetrics(metrics, prefix, second); err != nil {
+		t.Fatalf("addDerivedMetrics returned error: %s", err)
+	}
+
+	if got, want := metrics["latency.vda.await"], (50.0)/(20.0); got != want {
+		t.Errorf("latency.vda.await = %v, want %v", got, want)
+	}
+	if got, want := metrics["latency.vda.svctm"], (30.0)/(20.0); got != want {
+		t.Errorf("latency.vda.svctm = %v, want %v", got, want)
+	}
+	if got, want := metrics["util.vda.util"], (30.0)/(1000.0)*100; got != want {
+		t.Errorf("util.vda.util = %v, want %v", got, want)
+	}
+	if got, want := metrics["queue.vda.avgqu-sz"], (100.0)/(1000.0); got != want {
+		t.Errorf("queue.vda.avgqu-sz = %v, want %v", got, want)
+	}
+}
+
+func TestSafeDiv(t *testing.T) {
+	if got := safeDiv(10, 0); got != 0 {
+		t.Errorf("safeDiv(10, 0) = %v, want 0", got)
+	}
+	if got := safeDiv(10, 2); got != 5 {
+		t.Errorf("safeDiv(10, 2) = %v, want 5", got)
+	}
+}
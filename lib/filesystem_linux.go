@@ -0,0 +1,152 @@
+//go:build linux
+// +build linux
+
+package mpiostat
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// pseudoFilesystemTypes are mounted filesystems with no real backing
+// device or usable capacity; they're skipped when collecting filesystem
+// metrics.
+var pseudoFilesystemTypes = map[string]bool{
+	"tmpfs":    true,
+	"devtmpfs": true,
+	"proc":     true,
+	"sysfs":    true,
+	"overlay":  true,
+	"squashfs": true,
+}
+
+func isPseudoFilesystem(fstype string) bool {
+	return pseudoFilesystemTypes[fstype] || strings.HasPrefix(fstype, "cgroup")
+}
+
+type mountEntry struct {
+	device     string
+	mountpoint string
+	fstype     string
+}
+
+// filesystemGraphDefinition returns the graph definitions for the
+// filesystem capacity metrics collected by fetchFilesystemMetrics.
+func filesystemGraphDefinition(labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"size.#": {
+			Label: (labelPrefix + " Filesystem Size"),
+			Unit:  mp.UnitBytes,
+			Metrics: []mp.Metrics{
+				{Name: "size", Label: "size"},
+				{Name: "used", Label: "used"},
+				{Name: "free", Label: "free"},
+			},
+		},
+		"usedp.#": {
+			Label: (labelPrefix + " Filesystem Used Percentage"),
+			Unit:  mp.UnitPercentage,
+			Metrics: []mp.Metrics{
+				{Name: "usedp", Label: "used percentage"},
+			},
+		},
+		"inodes.#": {
+			Label: (labelPrefix + " Filesystem Inodes"),
+			Unit:  mp.UnitInteger,
+			Metrics: []mp.Metrics{
+				{Name: "used", Label: "used"},
+				{Name: "free", Label: "free"},
+			},
+		},
+	}
+}
+
+// fetchFilesystemMetrics parses /proc/mounts (falling back to /etc/mtab)
+// and statfs(2)s each real mount to produce capacity and inode metrics,
+// skipping pseudo filesystems and deduplicating bind mounts.
+func fetchFilesystemMetrics() (map[string]float64, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make(map[string]float64)
+	seen := make(map[string]bool) // dedupe key: "dev:ino" of the mountpoint
+	for _, mount := range mounts {
+		if isPseudoFilesystem(mount.fstype) {
+			continue
+		}
+
+		// EvalSymlinks resolves /dev/mapper/vg-lv (and similar) down to
+		// /dev/dm-0, which is the same name /proc/diskstats uses, so the
+		// label lines up with the IO metrics collected elsewhere.
+		real, err := filepath.EvalSymlinks(mount.device)
+		if err != nil {
+			continue
+		}
+
+		var mountStat syscall.Stat_t
+		if err := syscall.Stat(mount.mountpoint, &mountStat); err != nil {
+			continue
+		}
+		dedupeKey := fmt.Sprintf("%d:%d", mountStat.Dev, mountStat.Ino)
+		if seen[dedupeKey] {
+			continue
+		}
+		seen[dedupeKey] = true
+
+		label := deviceNamePattern.ReplaceAllString(filepath.Base(real), "")
+
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(mount.mountpoint, &fs); err != nil {
+			return nil, fmt.Errorf("Cannot statfs %s: %s", mount.mountpoint, err)
+		}
+
+		blockSize := uint64(fs.Bsize)
+		size := fs.Blocks * blockSize
+		free := fs.Bfree * blockSize
+		used := size - free
+
+		metrics["size."+label+".size"] = float64(size)
+		metrics["size."+label+".used"] = float64(used)
+		metrics["size."+label+".free"] = float64(free)
+		metrics["usedp."+label+".usedp"] = safeDiv(float64(used), float64(size)) * 100
+		metrics["inodes."+label+".used"] = float64(fs.Files - fs.Ffree)
+		metrics["inodes."+label+".free"] = float64(fs.Ffree)
+	}
+
+	return metrics, nil
+}
+
+func readMounts() ([]mountEntry, error) {
+	data, err := ioutil.ReadFile("/proc/mounts")
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile("/etc/mtab")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read mounts: %s", err)
+	}
+
+	return parseMounts(string(data)), nil
+}
+
+func parseMounts(data string) []mountEntry {
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{device: fields[0], mountpoint: fields[1], fstype: fields[2]})
+	}
+
+	return mounts
+}
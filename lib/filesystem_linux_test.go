@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package mpiostat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMounts(t *testing.T) {
+	data := `/dev/vda1 / ext4 rw,relatime 0 0
+tmpfs /dev/shm tmpfs rw,nosuid,nodev 0 0
+/dev/mapper/vg-lv /data xfs rw,relatime 0 0
+`
+	expected := []mountEntry{
+		{device: "/dev/vda1", mountpoint: "/", fstype: "ext4"},
+		{device: "tmpfs", mountpoint: "/dev/shm", fstype: "tmpfs"},
+		{device: "/dev/mapper/vg-lv", mountpoint: "/data", fstype: "xfs"},
+	}
+
+	got := parseMounts(data)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("parseMounts doesn't parse mounts as expected: got %+v", got)
+	}
+}
+
+func TestIsPseudoFilesystem(t *testing.T) {
+	for _, fstype := range []string{"tmpfs", "devtmpfs", "proc", "sysfs", "overlay", "squashfs", "cgroup", "cgroup2"} {
+		if !isPseudoFilesystem(fstype) {
+			t.Errorf("isPseudoFilesystem(%q) = false, want true", fstype)
+		}
+	}
+
+	for _, fstype := range []string{"ext4", "xfs", "btrfs"} {
+		if isPseudoFilesystem(fstype) {
+			t.Errorf("isPseudoFilesystem(%q) = true, want false", fstype)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package mpiostat
+
+import (
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// filesystemGraphDefinition and fetchFilesystemMetrics are only
+// implemented for linux, where /proc/mounts and statfs(2) give us
+// everything we need; -with-filesystems is a no-op elsewhere.
+
+func filesystemGraphDefinition(labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{}
+}
+
+func fetchFilesystemMetrics() (map[string]float64, error) {
+	return nil, nil
+}
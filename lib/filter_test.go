@@ -0,0 +1,40 @@
+package mpiostat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeviceAllowed(t *testing.T) {
+	cases := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    bool
+	}{
+		{"sda", nil, nil, true},
+		{"dm-0", nil, []string{"dm-*"}, false},
+		{"sda1", nil, []string{"dm-*"}, true},
+		{"dm-0", []string{"dm-*"}, nil, true},
+		{"sda1", []string{"dm-*"}, nil, false},
+		{"dm-0", []string{"dm-*"}, []string{"dm-*"}, true}, // include wins over exclude
+	}
+
+	for _, c := range cases {
+		if got := deviceAllowed(c.name, c.include, c.exclude); got != c.want {
+			t.Errorf("deviceAllowed(%q, %v, %v) = %v, want %v", c.name, c.include, c.exclude, got, c.want)
+		}
+	}
+}
+
+func TestSplitDeviceList(t *testing.T) {
+	if got := splitDeviceList(""); got != nil {
+		t.Errorf("splitDeviceList(\"\") = %v, want nil", got)
+	}
+
+	expected := []string{"dm-*", "loop?", "sd[a-c]"}
+	got := splitDeviceList("dm-*, loop?,sd[a-c]")
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("splitDeviceList(...) = %v, want %v", got, expected)
+	}
+}
@@ -1,32 +1,88 @@
 package mpiostat
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"os"
+	"log"
+	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin"
 )
 
 type IostatPlugin struct {
-	Prefix string
+	Prefix          string
+	IgnoreVirtual   bool
+	WithFilesystems bool
+	IncludeDevices  []string
+	ExcludeDevices  []string
 }
 
-// "Discard"s are introduced in Kernel 4.18. See linux/Documentation/iostats.txt for details.
-var metricNames = []string{
-	"request.reads", "merge.reads", "sector.read", "time.read",
-	"request.writes", "merge.writes", "sector.written", "time.write",
-	"inprogress.io", "time.io", "time.ioWeighted",
-	"request.discards", "merge.discards", "sector.Discarded", "time.discard",
+// Config mirrors IostatPlugin's flags for -config mode, so long
+// include/exclude device lists can be managed in a file instead of on the
+// command line. IgnoreVirtual and WithFilesystems are pointers so Do can
+// tell "omitted" from an explicit false and fall back to the flag default
+// instead of zeroing the field out.
+type Config struct {
+	MetricKeyPrefix string   `json:"metric_key_prefix"`
+	IgnoreVirtual   *bool    `json:"ignore_virtual"`
+	WithFilesystems *bool    `json:"with_filesystems"`
+	IncludeDevices  []string `json:"include_devices"`
+	ExcludeDevices  []string `json:"exclude_devices"`
 }
 
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read config file %s: %s", path, err)
+	}
+
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Cannot parse config file %s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+// deviceAllowed applies the -include-devices/-exclude-devices glob
+// filters: an explicit include match always wins; with no include list,
+// everything passes except explicit exclude matches.
+func deviceAllowed(name string, include, exclude []string) bool {
+	if len(include) > 0 {
+		return matchesAnyPattern(name, include)
+	}
+	return !matchesAnyPattern(name, exclude)
+}
+
+func matchesAnyPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var deviceNamePattern = regexp.MustCompile(`[^[[:alnum:]]_-]`)
+
+// diskstatsSource collects per-device IO counters for the host platform.
+// Each iostat_<goos>.go file registers its implementation in source via
+// an init() function, so FetchMetrics itself stays platform-agnostic.
+type diskstatsSource interface {
+	fetchMetrics(i IostatPlugin) (map[string]float64, error)
+}
+
+// source is assigned by the platform-specific implementation that gets
+// compiled in via build tags.
+var source diskstatsSource
+
 func (i IostatPlugin) GraphDefinition() map[string]mp.Graphs {
 	labelPrefix := strings.Title(i.MetricKeyPrefix())
-	return map[string]mp.Graphs{
+	graphs := map[string]mp.Graphs{
 		"request.#": {
 			Label: (labelPrefix + " Requests (/sec)"),
 			Unit:  mp.UnitIOPS,
@@ -48,7 +104,7 @@ func (i IostatPlugin) GraphDefinition() map[string]mp.Graphs {
 			Unit:  mp.UnitBytesPerSecond,
 			Metrics: []mp.Metrics{
 				// 1 sector is fixed to 512 bytes in Linux system.
-				// See https://github.com/torvalds/linux/blob/b219a1d2de0c025318475e3bbf8e3215cf49d083/Documentation/block/stat.txt#L50 for details.
+				// See https://github.com/torvalds/linux/blob/b219a1d2de0c025318475e3bbf8e3215cf49d083/Documentation/block/stat.txt#L50-L56 for details.
 				{Name: "read", Label: "read", Scale: 2, Diff: true},
 				{Name: "written", Label: "write", Scale: 2, Diff: true},
 			},
@@ -61,6 +117,15 @@ func (i IostatPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "write", Label: "write", Diff: true},
 				{Name: "io", Label: "io", Diff: true},
 				{Name: "ioWeighted", Label: "io weighted", Diff: true},
+				// Flushes are introduced in Kernel 5.5; see metricNamesV2.
+				{Name: "flush", Label: "flush", Diff: true},
+			},
+		},
+		"flush.#": {
+			Label: (labelPrefix + " Flush (/sec)"),
+			Unit:  mp.UnitIOPS,
+			Metrics: []mp.Metrics{
+				{Name: "requests", Label: "requests", Diff: true},
 			},
 		},
 		"inprogress.#": {
@@ -70,67 +135,78 @@ func (i IostatPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "io", Label: "io"},
 			},
 		},
+		"latency.#": {
+			Label: (labelPrefix + " Latency (ms)"),
+			Unit:  mp.UnitFloat,
+			Metrics: []mp.Metrics{
+				{Name: "await", Label: "await"},
+				{Name: "r_await", Label: "read await"},
+				{Name: "w_await", Label: "write await"},
+				{Name: "svctm", Label: "svctm"},
+			},
+		},
+		"util.#": {
+			Label: (labelPrefix + " Utilization (%)"),
+			Unit:  mp.UnitPercentage,
+			Metrics: []mp.Metrics{
+				{Name: "util", Label: "%util"},
+			},
+		},
+		"queue.#": {
+			Label: (labelPrefix + " Average Queue Size"),
+			Unit:  mp.UnitFloat,
+			Metrics: []mp.Metrics{
+				{Name: "avgqu-sz", Label: "avgqu-sz"},
+			},
+		},
 	}
+
+	if i.WithFilesystems {
+		for key, graph := range filesystemGraphDefinition(labelPrefix) {
+			graphs[key] = graph
+		}
+	}
+
+	return graphs
+}
+
+// rawCounters holds the raw, un-normalized accumulators that a
+// diskstatsSource needs to record per device so addDerivedMetrics can
+// compute the iostat -x-style latency.#, util.# and queue.# metrics from
+// the delta against the previous sample.
+type rawCounters struct {
+	Reads          float64 `json:"reads"`
+	Writes         float64 `json:"writes"`
+	TimeRead       float64 `json:"time_read"`
+	TimeWrite      float64 `json:"time_write"`
+	TimeIO         float64 `json:"time_io"`
+	TimeIOWeighted float64 `json:"time_io_weighted"`
 }
 
-/*
-$ cat /proc/diskstats
- 253       0 vda 1535048 279 41601294 520508 73249233 7260487 540931528 10616000 0 5871704 11113052
- 253       1 vda1 1534559 279 41576784 520420 46025748 7260487 540931528 8670868 0 3948708 9173652
- 253      16 vdb 72583 27934 814612 11784 36796 368511 3242456 23704 0 25272 35452
-*/
+// FetchMetrics delegates to the diskstatsSource registered for this
+// platform; see iostat_linux.go, iostat_darwin.go, iostat_freebsd.go and
+// iostat_windows.go.
 func (i IostatPlugin) FetchMetrics() (map[string]float64, error) {
-	io, err := ioutil.ReadFile("/proc/diskstats")
-	if err != nil {
-		return nil, fmt.Errorf("Cannot read from file /proc/diskstats: %s", err)
+	if source == nil {
+		return nil, fmt.Errorf("no diskstats source is registered for this platform")
 	}
 
-	blocks, err := i.fetchBlockdevices()
+	metrics, err := source.fetchMetrics(i)
 	if err != nil {
 		return nil, err
 	}
 
-	result := make(map[string]float64)
-	for _, line := range strings.Split(string(io), "\n") {
-		matches := strings.Fields(line)
-
-		// Skip for empty line. See https://github.com/golang/go/issues/13075 for details.
-		if len(matches) == 0 || len(matches[0]) == 0 {
-			continue
-		}
-
-		device := matches[2]
-
-		// Skip if it's a virtual.
-		if val, ok := blocks[device]; ok && !val {
-			continue
+	if i.WithFilesystems {
+		fsMetrics, err := fetchFilesystemMetrics()
+		if err != nil {
+			return nil, err
 		}
-
-		deviceNamePattern := regexp.MustCompile(`[^[[:alnum:]]_-]`)
-		deviceDispName := deviceNamePattern.ReplaceAllString(device, "")
-
-		for i, metric := range matches[3:] {
-			key := strings.Replace(metricNames[i], ".", "."+deviceDispName+".", 1)
-			result[key], err = strconv.ParseFloat(metric, 64)
-			if err != nil {
-				return nil, fmt.Errorf("Failed to parse value: %s", err)
-			}
-
-			switch strings.Split(key, ".")[0] {
-			case "request", "merge", "sector", "time":
-				/*
-					Mackerel is designed to display metrics in per-minute, while I want "per-second".
-
-					\frac{(\frac{crntVal}{60} - \frac{lastVal}{60}) * 60}{crntTime - lastTime} = \frac{crntVal - lastVal}{crntTime - lastTime}
-
-					See https://github.com/mackerelio/go-mackerel-plugin/blob/3980df9bc6311013061fb7ff66498ce23e275bdf/mackerel-plugin.go#L156 for details.
-				*/
-				result[key] /= 60
-			}
+		for key, value := range fsMetrics {
+			metrics[key] = value
 		}
 	}
 
-	return result, nil
+	return metrics, nil
 }
 
 func (i IostatPlugin) MetricKeyPrefix() string {
@@ -140,48 +216,61 @@ func (i IostatPlugin) MetricKeyPrefix() string {
 	return i.Prefix
 }
 
-func (i IostatPlugin) fetchBlockdevices() (map[string]bool, error) {
-	// Fetch list of block devices.
-	_blocks, err := ioutil.ReadDir("/sys/block")
-	if err != nil {
-		return nil, fmt.Errorf("Cannot read from directory /sys/block/: %s", err)
-	}
-
-	// Generate list of phyisical block devices to skip virtual ones, such as loopback.
-	blocks := make(map[string]bool)
-	for _, block := range _blocks {
-		blocks[block.Name()] = false
+func Do() {
+	optPrefix := flag.String("metric-key-prefix", "disk", "Metric key prefix")
+	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optVirtual := flag.Bool("ignore-virtual", true, "Ignore virtual block devices")
+	optFilesystems := flag.Bool("with-filesystems", false, "Also report filesystem capacity metrics")
+	optInclude := flag.String("include-devices", "", "Comma-separated list of device name globs to include")
+	optExclude := flag.String("exclude-devices", "", "Comma-separated list of device name globs to exclude")
+	optConfig := flag.String("config", "", "Path to a JSON config file mirroring the other flags")
+	flag.Parse()
 
-		// Check if it's not a symlink.
-		if block.Mode()&os.ModeSymlink != os.ModeSymlink {
-			continue
-		}
+	i := IostatPlugin{
+		Prefix:          *optPrefix,
+		IgnoreVirtual:   *optVirtual,
+		WithFilesystems: *optFilesystems,
+		IncludeDevices:  splitDeviceList(*optInclude),
+		ExcludeDevices:  splitDeviceList(*optExclude),
+	}
 
-		real, err := os.Readlink(fmt.Sprintf("/sys/block/%s", block.Name()))
+	if *optConfig != "" {
+		config, err := loadConfig(*optConfig)
 		if err != nil {
-			return nil, fmt.Errorf("Cannot read from directory /sys/block/%s: %s", block.Name(), err)
+			log.Fatal(err)
 		}
 
-		// Check if it's a virtual device.
-		if strings.HasPrefix(real, "../devices/virtual/block/") {
-			continue
+		if config.MetricKeyPrefix != "" {
+			i.Prefix = config.MetricKeyPrefix
+		}
+		if config.IgnoreVirtual != nil {
+			i.IgnoreVirtual = *config.IgnoreVirtual
+		}
+		if config.WithFilesystems != nil {
+			i.WithFilesystems = *config.WithFilesystems
+		}
+		if config.IncludeDevices != nil {
+			i.IncludeDevices = config.IncludeDevices
+		}
+		if config.ExcludeDevices != nil {
+			i.ExcludeDevices = config.ExcludeDevices
 		}
-
-		blocks[block.Name()] = true
 	}
 
-	return blocks, nil
+	plugin := mp.NewMackerelPlugin(i)
+	plugin.Tempfile = *optTempfile
+	plugin.Run()
 }
 
-func Do() {
-	optPrefix := flag.String("metric-key-prefix", "disk", "Metric key prefix")
-	optTempfile := flag.String("tempfile", "", "Temp file name")
-	flag.Parse()
+func splitDeviceList(value string) []string {
+	if value == "" {
+		return nil
+	}
 
-	i := IostatPlugin{
-		Prefix: *optPrefix,
+	patterns := make([]string, 0, strings.Count(value, ",")+1)
+	for _, pattern := range strings.Split(value, ",") {
+		patterns = append(patterns, strings.TrimSpace(pattern))
 	}
-	plugin := mp.NewMackerelPlugin(i)
-	plugin.Tempfile = *optTempfile
-	plugin.Run()
+
+	return patterns
 }
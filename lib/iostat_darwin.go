@@ -0,0 +1,69 @@
+//go:build darwin
+// +build darwin
+
+package mpiostat
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+func init() {
+	source = darwinDiskstatsSource{}
+}
+
+// darwinSlicePattern matches IOKit slice/partition nodes such as
+// "disk0s1". IOCounters reports these alongside the whole-disk "disk0"
+// entry; when IgnoreVirtual is set we only want the whole disk counted.
+var darwinSlicePattern = regexp.MustCompile(`^disk\d+s\d+$`)
+
+// darwinDiskstatsSource collects per-disk IO counters via gopsutil, which
+// wraps IOKit on darwin.
+type darwinDiskstatsSource struct{}
+
+func (darwinDiskstatsSource) fetchMetrics(i IostatPlugin) (map[string]float64, error) {
+	counters, err := disk.IOCounters()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot fetch disk IO counters: %s", err)
+	}
+
+	metrics := make(map[string]float64)
+	raw := make(map[string]rawCounters)
+	for name, c := range counters {
+		if i.IgnoreVirtual && darwinSlicePattern.MatchString(name) {
+			continue
+		}
+
+		if !deviceAllowed(name, i.IncludeDevices, i.ExcludeDevices) {
+			continue
+		}
+
+		label := deviceNamePattern.ReplaceAllString(name, "")
+		metrics["request."+label+".reads"] = float64(c.ReadCount)
+		metrics["request."+label+".writes"] = float64(c.WriteCount)
+		metrics["sector."+label+".read"] = float64(c.ReadBytes) / 512
+		metrics["sector."+label+".written"] = float64(c.WriteBytes) / 512
+		metrics["time."+label+".read"] = float64(c.ReadTime)
+		metrics["time."+label+".write"] = float64(c.WriteTime)
+		metrics["time."+label+".io"] = float64(c.IoTime)
+		metrics["time."+label+".ioWeighted"] = float64(c.WeightedIO)
+		metrics["inprogress."+label+".io"] = float64(c.IopsInProgress)
+
+		raw[label] = rawCounters{
+			Reads:          float64(c.ReadCount),
+			Writes:         float64(c.WriteCount),
+			TimeRead:       float64(c.ReadTime),
+			TimeWrite:      float64(c.WriteTime),
+			TimeIO:         float64(c.IoTime),
+			TimeIOWeighted: float64(c.WeightedIO),
+		}
+	}
+
+	if err := addDerivedMetrics(metrics, i.MetricKeyPrefix(), raw); err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+}
@@ -1,88 +1,63 @@
+//go:build linux
+// +build linux
+
 package mpiostat
 
 import (
-	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
-
-	mp "github.com/mackerelio/go-mackerel-plugin"
 )
 
-type IostatPlugin struct {
-	Prefix        string
-	IgnoreVirtual bool
+func init() {
+	source = linuxDiskstatsSource{}
 }
 
-var deviceNamePattern = regexp.MustCompile(`[^[[:alnum:]]_-]`)
-
-// "Discard"s are introduced in Kernel 4.18. See linux/Documentation/iostats.txt for details.
-var metricNames = []string{
+// metricNamesV0 covers the 11 counter columns present before Linux 4.18.
+var metricNamesV0 = []string{
 	"request.reads", "merge.reads", "sector.read", "time.read",
 	"request.writes", "merge.writes", "sector.written", "time.write",
 	"inprogress.io", "time.io", "time.ioWeighted",
-	"request.discards", "merge.discards", "sector.Discarded", "time.discard",
 }
 
-func (i IostatPlugin) GraphDefinition() map[string]mp.Graphs {
-	labelPrefix := strings.Title(i.MetricKeyPrefix())
-	return map[string]mp.Graphs{
-		"request.#": {
-			Label: (labelPrefix + " Requests (/sec)"),
-			Unit:  mp.UnitIOPS,
-			Metrics: []mp.Metrics{
-				{Name: "reads", Label: "read", Diff: true},
-				{Name: "writes", Label: "write", Diff: true},
-			},
-		},
-		"merge.#": {
-			Label: (labelPrefix + " Merge (/sec)"),
-			Unit:  mp.UnitFloat,
-			Metrics: []mp.Metrics{
-				{Name: "reads", Label: "read", Diff: true},
-				{Name: "writes", Label: "write", Diff: true},
-			},
-		},
-		"sector.#": {
-			Label: (labelPrefix + " Traffic"),
-			Unit:  mp.UnitBytesPerSecond,
-			Metrics: []mp.Metrics{
-				// 1 sector is fixed to 512 bytes in Linux system.
-				// See https://github.com/torvalds/linux/blob/b219a1d2de0c025318475e3bbf8e3215cf49d083/Documentation/block/stat.txt#L50-L56 for details.
-				{Name: "read", Label: "read", Scale: 2, Diff: true},
-				{Name: "written", Label: "write", Scale: 2, Diff: true},
-			},
-		},
-		"time.#": {
-			Label: (labelPrefix + " Time (ms/sec)"),
-			Unit:  mp.UnitFloat,
-			Metrics: []mp.Metrics{
-				{Name: "read", Label: "read", Diff: true},
-				{Name: "write", Label: "write", Diff: true},
-				{Name: "io", Label: "io", Diff: true},
-				{Name: "ioWeighted", Label: "io weighted", Diff: true},
-			},
-		},
-		"inprogress.#": {
-			Label: (labelPrefix + " IO in Progress"),
-			Unit:  mp.UnitInteger,
-			Metrics: []mp.Metrics{
-				{Name: "io", Label: "io"},
-			},
-		},
+// metricNamesV1 adds the 4 "discard" columns introduced in Linux 4.18. See
+// linux/Documentation/iostats.txt for details.
+var metricNamesV1 = append(append([]string{}, metricNamesV0...),
+	"request.discards", "merge.discards", "sector.Discarded", "time.discard",
+)
+
+// metricNamesV2 adds the 2 "flush" columns introduced in Linux 5.5.
+var metricNamesV2 = append(append([]string{}, metricNamesV1...),
+	"flush.requests", "time.flush",
+)
+
+// metricNamesForColumnCount picks the oldest metricNames table that still
+// covers every counter column present, so a 4.18-5.4 kernel's 15 columns
+// (no flush.*) don't get parsed against the 17-column table.
+func metricNamesForColumnCount(n int) []string {
+	switch {
+	case n >= len(metricNamesV2):
+		return metricNamesV2
+	case n >= len(metricNamesV1):
+		return metricNamesV1
+	default:
+		return metricNamesV0
 	}
 }
 
+// linuxDiskstatsSource reads /proc/diskstats and /sys/block, which is
+// where block device IO counters live on Linux.
+type linuxDiskstatsSource struct{}
+
 /*
 $ cat /proc/diskstats
  253       0 vda 1535048 279 41601294 520508 73249233 7260487 540931528 10616000 0 5871704 11113052
  253       1 vda1 1534559 279 41576784 520420 46025748 7260487 540931528 8670868 0 3948708 9173652
  253      16 vdb 72583 27934 814612 11784 36796 368511 3242456 23704 0 25272 35452
 */
-func (i IostatPlugin) FetchMetrics() (map[string]float64, error) {
+func (linuxDiskstatsSource) fetchMetrics(i IostatPlugin) (map[string]float64, error) {
 	io, err := ioutil.ReadFile("/proc/diskstats")
 	if err != nil {
 		return nil, fmt.Errorf("Cannot read from file /proc/diskstats: %s", err)
@@ -92,18 +67,19 @@ func (i IostatPlugin) FetchMetrics() (map[string]float64, error) {
 
 	// Create list of virtual devices if required.
 	if i.IgnoreVirtual {
-		devices, err := i.fetchBlockdevices()
+		devices, err := fetchBlockdevices()
 		if err != nil {
 			return nil, err
 		}
-		blocks, err = i.analyzeBlockdevices(devices)
+		blocks, err = analyzeBlockdevices(devices)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	metrics := make(map[string]float64)
-	for _, disk := range i.formatDiskstats(string(io)) {
+	raw := make(map[string]rawCounters)
+	for _, disk := range formatDiskstats(string(io)) {
 		device := disk[2]
 
 		// Skip if it's a virtual.
@@ -111,24 +87,60 @@ func (i IostatPlugin) FetchMetrics() (map[string]float64, error) {
 			continue
 		}
 
+		if !deviceAllowed(device, i.IncludeDevices, i.ExcludeDevices) {
+			continue
+		}
+
 		deviceDispName := deviceNamePattern.ReplaceAllString(device, "")
 
-		if err := i.parseStats(deviceDispName, disk, metrics); err != nil {
+		if err := parseStats(deviceDispName, disk, metrics); err != nil {
 			return nil, err
 		}
+
+		counters, err := rawCountersFromStats(disk)
+		if err != nil {
+			return nil, err
+		}
+		raw[deviceDispName] = counters
+	}
+
+	if err := addDerivedMetrics(metrics, i.MetricKeyPrefix(), raw); err != nil {
+		return nil, err
 	}
 
 	return metrics, nil
 }
 
-func (i IostatPlugin) MetricKeyPrefix() string {
-	if i.Prefix == "" {
-		i.Prefix = "disk"
+// rawCountersFromStats pulls the handful of /proc/diskstats columns that
+// addDerivedMetrics needs straight off the un-normalized row, since the
+// same values in metrics have already been scaled to per-second by
+// parseStats. Rows shorter than the pre-4.18 column count (e.g. a kernel
+// we don't have a mapping for yet) are skipped rather than indexed OOB.
+func rawCountersFromStats(stats []string) (rawCounters, error) {
+	if len(stats) < 14 {
+		return rawCounters{}, nil
+	}
+
+	fields := make([]float64, 0, 6)
+	for _, idx := range []int{3, 6, 7, 10, 12, 13} {
+		v, err := strconv.ParseFloat(stats[idx], 64)
+		if err != nil {
+			return rawCounters{}, fmt.Errorf("Failed to parse value: %s", err)
+		}
+		fields = append(fields, v)
 	}
-	return i.Prefix
+
+	return rawCounters{
+		Reads:          fields[0],
+		TimeRead:       fields[1],
+		Writes:         fields[2],
+		TimeWrite:      fields[3],
+		TimeIO:         fields[4],
+		TimeIOWeighted: fields[5],
+	}, nil
 }
 
-func (i IostatPlugin) formatDiskstats(stats string) [][]string {
+func formatDiskstats(stats string) [][]string {
 	result := [][]string{}
 
 	for _, line := range strings.Split(stats, "\n") {
@@ -145,18 +157,27 @@ func (i IostatPlugin) formatDiskstats(stats string) [][]string {
 	return result
 }
 
-func (i IostatPlugin) parseStats(label string, stats []string, metrics map[string]float64) error {
+func parseStats(label string, stats []string, metrics map[string]float64) error {
 	var err error
 
-	for i, metric := range stats[3:] {
-		key := strings.Replace(metricNames[i], ".", "."+label+".", 1) // e.g. "time.io" => "time.vda1.io"
+	counters := stats[3:]
+	names := metricNamesForColumnCount(len(counters))
+
+	for i, metric := range counters {
+		// Columns beyond the newest known table are from a kernel version
+		// we don't have a mapping for yet; ignore them rather than erroring.
+		if i >= len(names) {
+			break
+		}
+
+		key := strings.Replace(names[i], ".", "."+label+".", 1) // e.g. "time.io" => "time.vda1.io"
 		metrics[key], err = strconv.ParseFloat(metric, 64)
 		if err != nil {
 			return fmt.Errorf("Failed to parse value: %s", err)
 		}
 
 		switch strings.Split(key, ".")[0] {
-		case "request", "merge", "sector", "time":
+		case "request", "merge", "sector", "time", "flush":
 			/*
 				Mackerel is designed to display metrics in per-minute, while I want "per-second".
 				\frac{(\frac{crntVal}{60} - \frac{lastVal}{60}) * 60}{crntTime - lastTime} = \frac{crntVal - lastVal}{crntTime - lastTime}
@@ -169,7 +190,7 @@ func (i IostatPlugin) parseStats(label string, stats []string, metrics map[strin
 	return nil
 }
 
-func (i IostatPlugin) fetchBlockdevices() ([]os.FileInfo, error) {
+func fetchBlockdevices() ([]os.FileInfo, error) {
 	// Fetch list of block devices.
 	devices, err := ioutil.ReadDir("/sys/block")
 	if err != nil {
@@ -179,7 +200,7 @@ func (i IostatPlugin) fetchBlockdevices() ([]os.FileInfo, error) {
 	return devices, nil
 }
 
-func (i IostatPlugin) analyzeBlockdevices(devices []os.FileInfo) (map[string]bool, error) {
+func analyzeBlockdevices(devices []os.FileInfo) (map[string]bool, error) {
 	// Generate list of phyisical block devices to skip virtual ones, such as loopback.
 	blocks := make(map[string]bool)
 	for _, device := range devices {
@@ -205,18 +226,3 @@ func (i IostatPlugin) analyzeBlockdevices(devices []os.FileInfo) (map[string]boo
 
 	return blocks, nil
 }
-
-func Do() {
-	optPrefix := flag.String("metric-key-prefix", "disk", "Metric key prefix")
-	optTempfile := flag.String("tempfile", "", "Temp file name")
-	optVirtual := flag.Bool("ignore-virtual", true, "Temp file name")
-	flag.Parse()
-
-	i := IostatPlugin{
-		Prefix:        *optPrefix,
-		IgnoreVirtual: *optVirtual,
-	}
-	plugin := mp.NewMackerelPlugin(i)
-	plugin.Tempfile = *optTempfile
-	plugin.Run()
-}
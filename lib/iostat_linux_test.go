@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 package mpiostat
 
 import (
@@ -38,9 +41,7 @@ func TestFetchMetrics(t *testing.T) {
 	}
 }
 
-// TODO: Add test for kernel 4.19+
 func TestFormatDiskstats(t *testing.T) {
-	iostat := &IostatPlugin{}
 	stats := `   7       0 loop0 12330 0 26704 960 0 0 0 0 0 68 720
    7       1 loop1 278 0 2590 48 0 0 0 0 0 8 28
  252       0 vda 62695 0 2880751 26352 1383415 166185 10725792 396176 0 25204 301208
@@ -55,7 +56,7 @@ func TestFormatDiskstats(t *testing.T) {
 		{"252", "16", "vdb", "526", "62", "12008", "96", "964", "10253", "89736", "556", "0", "160", "280"},
 	}
 
-	got := iostat.formatDiskstats(stats)
+	got := formatDiskstats(stats)
 	if !reflect.DeepEqual(got, expected) {
 		t.Errorf("formatDiskstats doesn't format diskstats as expected")
 	}
@@ -63,7 +64,6 @@ func TestFormatDiskstats(t *testing.T) {
 
 // TODO: Test for more than 2 disks.
 func TestParseStats(t *testing.T) {
-	iostat := &IostatPlugin{}
 	stats := [][]string{
 		{"252", "0", "vda", "62695", "0", "2880751", "26352", "1383415", "166185", "10725792", "396176", "0", "25204", "301208"},
 	}
@@ -89,15 +89,56 @@ func TestParseStats(t *testing.T) {
 		*/
 	}
 	for _, disk := range stats {
-		iostat.parseStats(disk[2], disk, got)
+		parseStats(disk[2], disk, got)
 	}
 	if !reflect.DeepEqual(got, expected) {
 		t.Errorf("parseStats doesn't parse diskstats as expected")
 	}
 }
 
+// Kernel 5.5 adds "flush.requests" and "time.flush" as two trailing
+// columns; this covers a 17-column row plus two extra bogus trailing
+// columns, confirming unknown columns beyond metricNamesV2 are ignored
+// rather than causing an out-of-range panic or leaking into the metrics.
+func TestParseStatsV2(t *testing.T) {
+	stats := [][]string{
+		{"252", "0", "vda", "62695", "0", "2880751", "26352", "1383415", "166185", "10725792", "396176", "0", "25204", "301208", "0", "0", "5", "7", "12", "999", "111", "222"},
+	}
+	got := make(map[string]float64)
+
+	expected := map[string]float64{
+		"request.vda.reads":    (62695.0 / 60),
+		"merge.vda.reads":      (0.0 / 60),
+		"sector.vda.read":      (2880751.0 / 60),
+		"time.vda.read":        (26352.0 / 60),
+		"request.vda.writes":   (1383415.0 / 60),
+		"merge.vda.writes":     (166185.0 / 60),
+		"sector.vda.written":   (10725792.0 / 60),
+		"time.vda.write":       (396176.0 / 60),
+		"inprogress.vda.io":    0.0,
+		"time.vda.io":          (25204.0 / 60),
+		"time.vda.ioWeighted":  (301208.0 / 60),
+		"request.vda.discards": (0.0 / 60),
+		"merge.vda.discards":   (0.0 / 60),
+		"sector.vda.Discarded": (5.0 / 60),
+		"time.vda.discard":     (7.0 / 60),
+		"flush.vda.requests":   (12.0 / 60),
+		"time.vda.flush":       (999.0 / 60),
+	}
+	for _, disk := range stats {
+		if err := parseStats(disk[2], disk, got); err != nil {
+			t.Errorf("parseStats returned error: %s", err)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("parseStats doesn't parse a 17-column (kernel 5.5+) row as expected: got %+v", got)
+	}
+	if len(got) != len(expected) {
+		t.Errorf("parseStats produced %d metrics from the trailing bogus columns, want %d", len(got), len(expected))
+	}
+}
+
 func TestAnalyzeBlockdevices(t *testing.T) {
-	iostat := &IostatPlugin{}
 	devices := []fileStat{
 		fileStat{
 			name:    "vda",
@@ -187,7 +228,7 @@ func TestAnalyzeBlockdevices(t *testing.T) {
 	for i, _ := range devices {
 		devices_os = append(devices_os, os.FileInfo(&devices[i]))
 	}
-	got, err := iostat.analyzeBlockdevices(devices_os)
+	got, err := analyzeBlockdevices(devices_os)
 	if err != nil {
 		t.Errorf("analyzaBlockDevices returns error: %s", err)
 	}